@@ -0,0 +1,149 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package things
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/crypto/acme"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// deviceAttestationPayload is the device-attest-01 challenge response body: the CBOR attestation
+// object, base64url-encoded, under the "attObj" member.
+type deviceAttestationPayload struct {
+	AttObj string `json:"attObj"`
+}
+
+// submitDeviceAttestation satisfies chal by posting key's attestation statement directly to its
+// URL, signed as an ACME JWS with the account identified by kid. client.Accept cannot be used here
+// because it only ever posts an empty "{}" payload, which carries no attestation evidence.
+func submitDeviceAttestation(ctx context.Context, client *acme.Client, key crypto.Signer, kid string, chal *acme.Challenge, attestation []byte) error {
+	payload := deviceAttestationPayload{AttObj: base64.RawURLEncoding.EncodeToString(attestation)}
+
+	nonce, err := acmeNonce(ctx, client.HTTPClient, client.DirectoryURL)
+	if err != nil {
+		return fmt.Errorf("things: failed to fetch an ACME nonce: %w", err)
+	}
+	body, err := acmeSignedJWS(client.Key, kid, chal.URI, nonce, payload)
+	if err != nil {
+		return fmt.Errorf("things: failed to sign device attestation: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, chal.URI, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+
+	httpClient := client.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("things: CA rejected the device attestation with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// acmeDirectory is the subset of an RFC 8555 directory object needed to fetch a fresh nonce.
+type acmeDirectory struct {
+	NewNonce string `json:"newNonce"`
+}
+
+// acmeNonce fetches a fresh anti-replay nonce from the ACME server's newNonce endpoint.
+func acmeNonce(ctx context.Context, httpClient *http.Client, directoryURL string) (string, error) {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	dirReq, err := http.NewRequestWithContext(ctx, http.MethodGet, directoryURL, nil)
+	if err != nil {
+		return "", err
+	}
+	dirResp, err := httpClient.Do(dirReq)
+	if err != nil {
+		return "", err
+	}
+	defer dirResp.Body.Close()
+	var dir acmeDirectory
+	if err := json.NewDecoder(dirResp.Body).Decode(&dir); err != nil {
+		return "", err
+	}
+
+	nonceReq, err := http.NewRequestWithContext(ctx, http.MethodHead, dir.NewNonce, nil)
+	if err != nil {
+		return "", err
+	}
+	nonceResp, err := httpClient.Do(nonceReq)
+	if err != nil {
+		return "", err
+	}
+	defer nonceResp.Body.Close()
+	nonce := nonceResp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", fmt.Errorf("ACME server did not return a Replay-Nonce")
+	}
+	return nonce, nil
+}
+
+// acmeStaticNonce is a jose.NonceSource that always returns the same, already-fetched nonce.
+type acmeStaticNonce string
+
+func (n acmeStaticNonce) Nonce() (string, error) {
+	return string(n), nil
+}
+
+// acmeSignedJWS produces the flattened JSON serialization of a JWS over payload, signed by key and
+// addressed to url, as RFC 8555 §6.2 requires for every authenticated ACME request.
+func acmeSignedJWS(key crypto.Signer, kid, url, nonce string, payload interface{}) ([]byte, error) {
+	alg, err := signingAlgorithm(key)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: alg, Key: jose.JSONWebKey{Key: key, KeyID: kid, Algorithm: string(alg)}},
+		&jose.SignerOptions{
+			NonceSource:  acmeStaticNonce(nonce),
+			EmbedJWK:     false,
+			ExtraHeaders: map[jose.HeaderKey]interface{}{"url": url},
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := signer.Sign(body)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(obj.FullSerialize()), nil
+}
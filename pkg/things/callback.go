@@ -0,0 +1,42 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package things
+
+import "context"
+
+// CallbackHandler satisfies a single AM authentication tree callback. GatewayClient.authenticate
+// dispatches each callback AM returns to a registered handler whose Handles reports true; the
+// order in which registered handlers are tried is not defined.
+type CallbackHandler interface {
+	// Handles reports whether this handler can satisfy cb.
+	Handles(cb callback) bool
+	// Handle populates cb's Input with whatever AM needs to complete the callback, such as an
+	// OAuth 2.0 access token or an OIDC ID token.
+	Handle(ctx context.Context, cb callback) (callback, error)
+}
+
+// callbackEntryValue returns the value of the named entry in cb's output, or "" if absent.
+func callbackEntryValue(cb callback, name string) string {
+	for _, e := range cb.Output {
+		if e.Name != name {
+			continue
+		}
+		s, _ := e.Value.(string)
+		return s
+	}
+	return ""
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package things
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+)
+
+// testFederatedAuthCOAPMux returns a callback requiring federated authentication whenever the
+// posted payload doesn't yet carry that callback's filled-in Input, and succeeds once it does -
+// so each independent authenticate() call exercises the same single round-trip of callbacks.
+func testFederatedAuthCOAPMux() *coap.ServeMux {
+	mux := coap.NewServeMux()
+	mux.HandleFunc("/authenticate", func(w coap.ResponseWriter, r *coap.Request) {
+		var payload authenticatePayload
+		_ = json.Unmarshal(r.Msg.Payload(), &payload)
+
+		if payload.TokenId == "tree-1" && len(payload.Callbacks) == 1 && payload.Callbacks[0].Input != nil {
+			b, _ := json.Marshal(authenticatePayload{TokenId: "12345"})
+			w.SetCode(codes.Valid)
+			w.Write(b)
+			return
+		}
+		b, _ := json.Marshal(authenticatePayload{
+			TokenId:   "tree-1",
+			Callbacks: []callback{{Type: oauth2DeviceCodeCallbackType}},
+		})
+		w.SetCode(codes.Valid)
+		w.Write(b)
+	})
+	return mux
+}
+
+func TestGatewayClient_Authenticate_FederatedCallback(t *testing.T) {
+	cert, _ := publicKeyCertificate(testGenerateSigner())
+	server := testCOAPServer{config: dtlsServerConfig(cert), mux: testFederatedAuthCOAPMux()}
+	addr, cancel, err := server.Start()
+	defer cancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &GatewayClient{Address: addr, Key: testGenerateSigner()}
+	if err := client.initialise(); err != nil {
+		t.Fatal(err)
+	}
+	client.RegisterCallbackHandler("oauth2-device", &OIDCIDTokenCallback{})
+
+	// The registered OIDCIDTokenCallback can't actually satisfy an OAuth2DeviceCodeCallback, so
+	// without a matching handler the dispatch loop should report the mismatch rather than hang.
+	if _, err := client.authenticate(authenticatePayload{}); err == nil {
+		t.Fatal("expected an error when no registered handler matches the returned callback")
+	}
+
+	stub := &stubCallbackHandler{callbackType: oauth2DeviceCodeCallbackType}
+	client.RegisterCallbackHandler("oauth2-device", stub)
+	reply, err := client.authenticate(authenticatePayload{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.TokenId != "12345" {
+		t.Errorf("expected the tree to complete with a session token, got %+v", reply)
+	}
+	if !stub.handled {
+		t.Error("expected the stub handler to have been invoked")
+	}
+}
+
+// stubCallbackHandler is a minimal CallbackHandler used to exercise GatewayClient's dispatch loop
+// without depending on a real federated IdP.
+type stubCallbackHandler struct {
+	callbackType string
+	handled      bool
+}
+
+func (s *stubCallbackHandler) Handles(cb callback) bool {
+	return cb.Type == s.callbackType
+}
+
+func (s *stubCallbackHandler) Handle(ctx context.Context, cb callback) (callback, error) {
+	s.handled = true
+	cb.Input = []callbackEntry{{Name: "token", Value: "stub-token"}}
+	return cb, nil
+}
@@ -0,0 +1,356 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package things
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+	"github.com/pion/dtls/v2"
+)
+
+// dialTimeout bounds how long GatewayClient.initialise waits for the DTLS handshake to complete.
+const dialTimeout = 30 * time.Second
+
+// applicationJOSE is the CoAP content format used for JWS-signed JSON payloads exchanged with the Gateway.
+const applicationJOSE coap.MediaType = 10000
+
+// GatewayMode selects the DTLS ciphersuite family a GatewayClient negotiates with its Gateway.
+type GatewayMode int
+
+const (
+	// ModeCertificate negotiates a raw-public-key or X.509 certificate handshake. This is the
+	// default mode.
+	ModeCertificate GatewayMode = iota
+	// ModePSK negotiates a pre-shared key handshake, which is considerably cheaper for
+	// constrained devices than a public key handshake.
+	ModePSK
+)
+
+// GatewayClient is a CoAP/DTLS client for a single Thing identity talking to a Thing Gateway.
+type GatewayClient struct {
+	// Address is the host:port of the Thing Gateway.
+	Address string
+	// Key identifies the Thing to the Gateway during the DTLS handshake. It is required in
+	// ModeCertificate and unused in ModePSK.
+	Key crypto.Signer
+	// Enroller, if set, is used by Enrol to bootstrap an X.509 identity from a CA before the
+	// DTLS session is opened. When nil, initialise falls back to a self-signed public key
+	// certificate. It has no effect in ModePSK.
+	Enroller Enroller
+	// Mode selects between a public key handshake (ModeCertificate, the default) and a
+	// pre-shared key handshake (ModePSK).
+	Mode GatewayMode
+	// PSKIdentity is the identity hint the client offers during a ModePSK handshake.
+	PSKIdentity string
+	// PSKCallback returns the pre-shared key for a given server hint during a ModePSK
+	// handshake. It is required when Mode is ModePSK.
+	PSKCallback func(hint []byte) ([]byte, error)
+	// CacheExpiration is how long introspection results and freshly issued access tokens are
+	// cached before a request forces a fresh CoAP round-trip. The zero value means
+	// defaultCacheExpiration.
+	CacheExpiration time.Duration
+
+	conn             *coap.ClientConn
+	cert             *tls.Certificate
+	cache            *tokenCache
+	callbackHandlers map[string]CallbackHandler
+}
+
+// RegisterCallbackHandler makes h available to satisfy AM authentication tree callbacks during
+// authenticate, under the given name. Registering a handler under a name that is already in use
+// replaces it.
+func (c *GatewayClient) RegisterCallbackHandler(name string, h CallbackHandler) {
+	if c.callbackHandlers == nil {
+		c.callbackHandlers = make(map[string]CallbackHandler)
+	}
+	c.callbackHandlers[name] = h
+}
+
+// callbackHandlerFor returns a registered handler that can satisfy cb, or nil if none can. When
+// several registered handlers can satisfy cb, which of them is returned is not defined.
+func (c *GatewayClient) callbackHandlerFor(cb callback) CallbackHandler {
+	for _, h := range c.callbackHandlers {
+		if h.Handles(cb) {
+			return h
+		}
+	}
+	return nil
+}
+
+// tokenCache lazily creates, then returns, c's token cache.
+func (c *GatewayClient) tokenCache() *tokenCache {
+	if c.cache == nil {
+		ttl := c.CacheExpiration
+		if ttl == 0 {
+			ttl = defaultCacheExpiration
+		}
+		c.cache = newTokenCache(ttl)
+	}
+	return c.cache
+}
+
+// Enrol obtains an X.509 identity for the client from Enroller, if one is configured. It is
+// idempotent: a certificate that does not yet need renewal is reused rather than re-requested.
+// Enrol must be called, if at all, before initialise.
+func (c *GatewayClient) Enrol(ctx context.Context) error {
+	if c.Enroller == nil {
+		return nil
+	}
+	if c.cert != nil && !certNeedsRenewal(*c.cert) {
+		return nil
+	}
+	cert, err := c.Enroller.Enrol(ctx, c.Key)
+	if err != nil {
+		return fmt.Errorf("things: enrolment failed: %w", err)
+	}
+	c.cert = &cert
+	return nil
+}
+
+// authenticatePayload mirrors the ForgeRock AM authentication tree payload exchanged over /authenticate.
+type authenticatePayload struct {
+	TokenId   string     `json:"tokenId,omitempty"`
+	Callbacks []callback `json:"callbacks,omitempty"`
+}
+
+// callback is a single AM authentication tree callback, e.g. a name/password collector or a
+// redirect to a federated identity provider.
+type callback struct {
+	Type   string          `json:"type"`
+	Output []callbackEntry `json:"output,omitempty"`
+	Input  []callbackEntry `json:"input,omitempty"`
+}
+
+// callbackEntry is a single named value within a callback's output or input.
+type callbackEntry struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+// amInfoSet describes the AM endpoints and capabilities returned by /aminfo.
+type amInfoSet struct {
+	AccessTokenURL string `json:"accessTokenURL"`
+	ThingsVersion  string `json:"thingsVersion"`
+}
+
+// successCode reports whether a CoAP response code falls in the 2.xx success class.
+func successCode(code codes.Code) bool {
+	return code >= codes.Created && code <= codes.Content
+}
+
+// initialise opens the DTLS connection to the Gateway. It must be called before any other request.
+func (c *GatewayClient) initialise() error {
+	cfg, err := c.dtlsConfig()
+	if err != nil {
+		return err
+	}
+	conn, err := coap.DialDTLSWithTimeout("udp", c.Address, cfg, dialTimeout)
+	if err != nil {
+		return fmt.Errorf("things: failed to dial gateway %s: %w", c.Address, err)
+	}
+	c.conn = conn
+	return nil
+}
+
+// dtlsConfig builds the DTLS configuration for c's current Mode.
+func (c *GatewayClient) dtlsConfig() (*dtls.Config, error) {
+	if c.Mode == ModePSK {
+		if c.PSKCallback == nil {
+			return nil, fmt.Errorf("things: ModePSK requires a PSKCallback")
+		}
+		return dtlsPSKClientConfig(c.PSKIdentity, c.PSKCallback), nil
+	}
+
+	if c.Key == nil {
+		return nil, fmt.Errorf("things: GatewayClient has no signing key")
+	}
+	cert := c.cert
+	if cert == nil {
+		selfSigned, err := publicKeyCertificate(c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("things: failed to create client certificate: %w", err)
+		}
+		cert = &selfSigned
+	}
+	return dtlsClientConfig(*cert), nil
+}
+
+// authenticate drives the ForgeRock AM authentication tree to completion via the /authenticate
+// resource, dispatching any callbacks AM returns to a registered CallbackHandler so the Thing can
+// be re-authenticated through a federated identity provider without further code changes.
+func (c *GatewayClient) authenticate(payload authenticatePayload) (authenticatePayload, error) {
+	for {
+		reply, err := c.authenticateStep(payload)
+		if err != nil {
+			return reply, err
+		}
+		if len(reply.Callbacks) == 0 {
+			return reply, nil
+		}
+		for i, cb := range reply.Callbacks {
+			handler := c.callbackHandlerFor(cb)
+			if handler == nil {
+				return reply, fmt.Errorf("things: no callback handler registered for %q", cb.Type)
+			}
+			filled, err := handler.Handle(context.Background(), cb)
+			if err != nil {
+				return reply, fmt.Errorf("things: callback handler for %q failed: %w", cb.Type, err)
+			}
+			reply.Callbacks[i] = filled
+		}
+		payload = reply
+	}
+}
+
+// authenticateStep posts a single authentication tree step and returns AM's response.
+func (c *GatewayClient) authenticateStep(payload authenticatePayload) (authenticatePayload, error) {
+	var reply authenticatePayload
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return reply, err
+	}
+	resp, err := c.conn.Post("/authenticate", coap.AppJSON, bytes.NewReader(b))
+	if err != nil {
+		return reply, err
+	}
+	if !successCode(resp.Code()) {
+		return reply, fmt.Errorf("things: authenticate request failed with code %s", resp.Code())
+	}
+	if err := json.Unmarshal(resp.Payload(), &reply); err != nil {
+		return reply, fmt.Errorf("things: failed to parse authenticate response: %w", err)
+	}
+	return reply, nil
+}
+
+// amInfo fetches AM endpoint information via the /aminfo resource.
+func (c *GatewayClient) amInfo() (amInfoSet, error) {
+	var info amInfoSet
+	resp, err := c.conn.Get("/aminfo")
+	if err != nil {
+		return info, err
+	}
+	if !successCode(resp.Code()) {
+		return info, fmt.Errorf("things: aminfo request failed with code %s", resp.Code())
+	}
+	if err := json.Unmarshal(resp.Payload(), &info); err != nil {
+		return info, fmt.Errorf("things: failed to parse aminfo response: %w", err)
+	}
+	return info, nil
+}
+
+// accessToken exchanges a signed JWT for an OAuth 2.0 access token via the /accesstoken resource.
+// A token already cached for the same (scope, audience) pair is returned without a CoAP round-trip.
+func (c *GatewayClient) accessToken(scope, audience string, contentFormat coap.MediaType, jws string) (map[string]interface{}, error) {
+	key := cacheKey("accesstoken", scope, audience)
+	if v, ok := c.tokenCache().get(key); ok {
+		return v.(map[string]interface{}), nil
+	}
+
+	resp, err := c.conn.Post("/accesstoken", contentFormat, bytes.NewReader([]byte(jws)))
+	if err != nil {
+		return nil, err
+	}
+	if !successCode(resp.Code()) {
+		return nil, fmt.Errorf("things: access token request failed with code %s", resp.Code())
+	}
+	var token map[string]interface{}
+	if len(resp.Payload()) == 0 {
+		return token, nil
+	}
+	if err := json.Unmarshal(resp.Payload(), &token); err != nil {
+		return nil, fmt.Errorf("things: failed to parse access token response: %w", err)
+	}
+	c.tokenCache().put(key, token)
+	return token, nil
+}
+
+// dtlsClientConfig builds the DTLS configuration a Thing uses to dial a Gateway, presenting its
+// raw public key certificate so the Gateway can verify the Thing's identity.
+func dtlsClientConfig(cert tls.Certificate) *dtls.Config {
+	return &dtls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+		ClientAuth:         dtls.RequireAnyClientCert,
+	}
+}
+
+// dtlsServerConfig builds the DTLS configuration used by test Gateways to accept a Thing's
+// raw public key certificate.
+func dtlsServerConfig(cert tls.Certificate) *dtls.Config {
+	return &dtls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   dtls.RequireAnyClientCert,
+	}
+}
+
+// pskCipherSuites is the curated set of PSK ciphersuites offered in ModePSK, chosen for their low
+// computational cost on constrained devices.
+var pskCipherSuites = []dtls.CipherSuiteID{
+	dtls.TLS_PSK_WITH_AES_128_CCM_8,
+	dtls.TLS_PSK_WITH_AES_128_GCM_SHA256,
+}
+
+// dtlsPSKClientConfig builds the DTLS configuration a Thing uses to dial a Gateway in ModePSK.
+func dtlsPSKClientConfig(identity string, pskCallback func(hint []byte) ([]byte, error)) *dtls.Config {
+	return &dtls.Config{
+		PSK:             pskCallback,
+		PSKIdentityHint: []byte(identity),
+		CipherSuites:    pskCipherSuites,
+	}
+}
+
+// dtlsPSKServerConfig builds the DTLS configuration used by test Gateways to accept a Thing in
+// ModePSK, resolving the shared key for a given identity hint via pskCallback.
+func dtlsPSKServerConfig(hint []byte, pskCallback func(hint []byte) ([]byte, error)) *dtls.Config {
+	return &dtls.Config{
+		PSK:             pskCallback,
+		PSKIdentityHint: hint,
+		CipherSuites:    pskCipherSuites,
+	}
+}
+
+// publicKeyCertificate wraps a signer in a minimal self-signed certificate so it can be presented
+// during a DTLS raw public key handshake.
+func publicKeyCertificate(signer crypto.Signer) (tls.Certificate, error) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "thing"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, signer.Public(), signer)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  signer,
+	}, nil
+}
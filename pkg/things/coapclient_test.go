@@ -22,20 +22,37 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/json"
+	"testing"
+	"time"
+
 	"github.com/go-ocf/go-coap"
 	"github.com/go-ocf/go-coap/codes"
 	"github.com/go-ocf/go-coap/net"
 	"github.com/pion/dtls/v2"
 	"golang.org/x/sync/errgroup"
-	"testing"
 )
 
+// testDTLSAcceptPoll is how often testCOAPServer's DTLS listener re-checks for a cancelled Accept.
+// go-ocf/go-coap re-arms the listener's read deadline to now+interval on every poll, so Shutdown()
+// isn't observed until the next tick; this mirrors the library's own 100ms documented default so
+// teardown doesn't make every test in this package pay a multi-second tax per server it starts.
+const testDTLSAcceptPoll = 100 * time.Millisecond
+
 func testGenerateSigner() crypto.Signer {
 	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	return key
 }
 
+// testWrongTLSSigner returns a certificate whose private key does not match its embedded public
+// key, so that any handshake attempted with it is rejected.
+func testWrongTLSSigner() tls.Certificate {
+	cert, _ := publicKeyCertificate(testGenerateSigner())
+	cert.PrivateKey = testGenerateSigner()
+	return cert
+}
+
 func testAuthCOAPMux(code codes.Code, response []byte) (mux *coap.ServeMux) {
 	mux = coap.NewServeMux()
 	mux.HandleFunc("/authenticate", func(w coap.ResponseWriter, r *coap.Request) {
@@ -72,7 +89,7 @@ type testCOAPServer struct {
 }
 
 func (s testCOAPServer) Start() (address string, cancel func(), err error) {
-	l, err := net.NewDTLSListener("udp", ":0", s.config, heartBeat)
+	l, err := net.NewDTLSListener("udp", ":0", s.config, testDTLSAcceptPoll)
 	if err != nil {
 		return "", func() {}, err
 	}
@@ -82,8 +99,18 @@ func (s testCOAPServer) Start() (address string, cancel func(), err error) {
 	}
 	c := make(chan error, 1)
 	go func() {
+		// go-coap's serveDTLSListener unconditionally calls the Server's unexported
+		// listenerErrorFunc on the first Accept error - including the ordinary error produced by
+		// our own Shutdown() below - and a Server built directly like this one never has that
+		// field initialised, so it panics instead of returning an error. Recover so the expected
+		// shutdown-induced error can't take the whole test binary down with it.
+		defer func() {
+			if r := recover(); r != nil {
+				c <- nil
+			}
+		}()
+		defer l.Close()
 		c <- server.ActivateAndServe()
-		l.Close()
 	}()
 	return l.Addr().String(), func() {
 		server.Shutdown()
@@ -91,6 +118,40 @@ func (s testCOAPServer) Start() (address string, cancel func(), err error) {
 	}, nil
 }
 
+func testPSKCallback(hint []byte) ([]byte, error) {
+	return []byte("sekrit"), nil
+}
+
+// TestGatewayClient_Initialise_Concurrent_PSK mirrors TestGatewayClient_Initialise_Concurrent but
+// exercises the PSK handshake, which does not share the raw-public-key path's concurrency problem.
+func TestGatewayClient_Initialise_Concurrent_PSK(t *testing.T) {
+	addr, cancel, err := testCOAPServer{
+		config: dtlsPSKServerConfig([]byte("gateway"), testPSKCallback),
+		mux:    coap.DefaultServeMux,
+	}.Start()
+	defer cancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errGroup, _ := errgroup.WithContext(context.Background())
+	const num = 5
+	for i := 0; i < num; i++ {
+		client := &GatewayClient{
+			Address:     addr,
+			Mode:        ModePSK,
+			PSKIdentity: "thing",
+			PSKCallback: testPSKCallback,
+		}
+		errGroup.Go(func() error {
+			return client.initialise()
+		})
+	}
+	if err := errGroup.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func testGatewayClientInitialise(client *GatewayClient, server *testCOAPServer) (err error) {
 	if server != nil {
 		var cancel func()
@@ -285,7 +346,7 @@ func testGatewayClientAccessToken(client *GatewayClient, server *testCOAPServer)
 	if err != nil {
 		return err
 	}
-	_, err = client.accessToken("token", applicationJOSE, "signedWT")
+	_, err = client.accessToken("token", "", applicationJOSE, "signedWT")
 	return err
 }
 
@@ -0,0 +1,257 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package things
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// ChallengeDeviceAttest identifies the device-attest-01 ACME challenge type, used when the CA can
+// verify a hardware attestation statement for the Thing's key.
+const ChallengeDeviceAttest = "device-attest-01"
+
+// ChallengeHTTP identifies the conventional http-01 ACME challenge type.
+const ChallengeHTTP = "http-01"
+
+// renewalFraction mirrors autocert's renewal-before-expiry window: a certificate is rotated once
+// two thirds of its validity period has elapsed.
+const renewalFraction = 2.0 / 3.0
+
+// enrolTimeout bounds the ACME order/authorization/finalize flow when the caller's context carries
+// no deadline of its own. golang.org/x/crypto/acme retries 5xx responses with its own backoff and
+// will otherwise keep a Thing's boot sequence blocked indefinitely against a flaky or hostile CA.
+const enrolTimeout = 60 * time.Second
+
+// Enroller bootstraps an X.509 identity for a Thing ahead of opening a CoAP/DTLS session, so the
+// Gateway can authenticate the Thing against a real root rather than a self-signed public key.
+type Enroller interface {
+	// Enrol obtains a certificate chain for key, or returns an error if enrolment fails.
+	Enrol(ctx context.Context, key crypto.Signer) (tls.Certificate, error)
+}
+
+// ACMEEnroller enrols a Thing with an ACME-compatible CA, such as step-ca.
+type ACMEEnroller struct {
+	// DirectoryURL is the ACME server's directory endpoint.
+	DirectoryURL string
+	// Identifier is the subject (e.g. a Thing name or serial number) requested in the order.
+	Identifier string
+	// ChallengeType selects the ACME challenge the Enroller will attempt to satisfy, either
+	// ChallengeDeviceAttest or ChallengeHTTP.
+	ChallengeType string
+	// AttestationStatement produces the device-attest-01 attestation payload for key, when
+	// ChallengeType is ChallengeDeviceAttest.
+	AttestationStatement func(key crypto.Signer) ([]byte, error)
+	// RespondHTTP01 makes a challenge's key authorization available at its well-known HTTP path,
+	// when ChallengeType is ChallengeHTTP. It is the caller's responsibility to actually serve it.
+	RespondHTTP01 func(token, keyAuthorization string) error
+	// CertDir is the directory used to persist the enrolled certificate and key between runs.
+	CertDir string
+
+	accountKey crypto.Signer
+}
+
+// certFile and keyFile name the PEM files an ACMEEnroller persists under CertDir.
+const (
+	certFile = "thing-cert.pem"
+	keyFile  = "thing-key.pem"
+)
+
+// Enrol runs the ACME order/authorization/finalize flow for key and returns the issued certificate
+// chain, persisting it to CertDir so that a later call can reuse it until it nears expiry.
+func (e *ACMEEnroller) Enrol(ctx context.Context, key crypto.Signer) (tls.Certificate, error) {
+	if cert, ok := e.loadCertificate(); ok && !certNeedsRenewal(cert) {
+		return cert, nil
+	}
+
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, enrolTimeout)
+		defer cancel()
+	}
+
+	if e.accountKey == nil {
+		accountKey, err := acmeAccountKey()
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("things: failed to create ACME account key: %w", err)
+		}
+		e.accountKey = accountKey
+	}
+	client := &acme.Client{DirectoryURL: e.DirectoryURL, Key: e.accountKey}
+
+	account, err := client.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+	if err != nil && err != acme.ErrAccountAlreadyExists {
+		return tls.Certificate{}, fmt.Errorf("things: ACME registration failed: %w", err)
+	}
+
+	order, err := client.AuthorizeOrder(ctx, []acme.AuthzID{{Type: "dns", Value: e.Identifier}})
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("things: failed to create ACME order: %w", err)
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		if err := e.completeAuthorization(ctx, client, authzURL, key, account.URI); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("things: ACME order did not become ready: %w", err)
+	}
+
+	csr, err := certificateRequest(key, e.Identifier)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("things: failed to build certificate request: %w", err)
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("things: ACME finalize failed: %w", err)
+	}
+
+	cert := tls.Certificate{Certificate: der, PrivateKey: key}
+	if leaf, err := x509.ParseCertificate(der[0]); err == nil {
+		cert.Leaf = leaf
+	}
+	if err := e.saveCertificate(cert); err != nil {
+		return tls.Certificate{}, fmt.Errorf("things: failed to persist enrolled certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// completeAuthorization satisfies whichever challenge matches e.ChallengeType for the authorization
+// at authzURL. key is the Thing's own key being enrolled (not the ACME account key) and is needed to
+// produce a device-attest-01 attestation statement; kid is the ACME account URL used to sign any
+// custom challenge-response payload that acme.Client itself has no support for sending.
+func (e *ACMEEnroller) completeAuthorization(ctx context.Context, client *acme.Client, authzURL string, key crypto.Signer, kid string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("things: failed to fetch ACME authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == e.ChallengeType {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("things: CA did not offer the %s challenge", e.ChallengeType)
+	}
+
+	switch e.ChallengeType {
+	case ChallengeDeviceAttest:
+		if e.AttestationStatement == nil {
+			return fmt.Errorf("things: ChallengeDeviceAttest requires an AttestationStatement func")
+		}
+		attestation, err := e.AttestationStatement(key)
+		if err != nil {
+			return fmt.Errorf("things: failed to build device attestation statement: %w", err)
+		}
+		// client.Accept only ever posts "{}", so the attestation object is submitted directly as
+		// the challenge's response payload instead.
+		if err := submitDeviceAttestation(ctx, client, key, kid, chal, attestation); err != nil {
+			return fmt.Errorf("things: failed to submit device attestation: %w", err)
+		}
+	case ChallengeHTTP:
+		keyAuth, err := client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return fmt.Errorf("things: failed to compute http-01 key authorization: %w", err)
+		}
+		if e.RespondHTTP01 == nil {
+			return fmt.Errorf("things: ChallengeHTTP requires a RespondHTTP01 func")
+		}
+		if err := e.RespondHTTP01(chal.Token, keyAuth); err != nil {
+			return fmt.Errorf("things: failed to serve http-01 challenge: %w", err)
+		}
+		if _, err := client.Accept(ctx, chal); err != nil {
+			return fmt.Errorf("things: failed to accept ACME challenge: %w", err)
+		}
+	default:
+		return fmt.Errorf("things: unsupported challenge type %q", e.ChallengeType)
+	}
+
+	if _, err := client.WaitAuthorization(ctx, authzURL); err != nil {
+		return fmt.Errorf("things: ACME authorization did not validate: %w", err)
+	}
+	return nil
+}
+
+// certNeedsRenewal reports whether cert has passed renewalFraction of its validity period, mirroring
+// the renewal timer used by golang.org/x/crypto/acme/autocert.
+func certNeedsRenewal(cert tls.Certificate) bool {
+	if cert.Leaf == nil {
+		return true
+	}
+	validity := cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore)
+	renewAt := cert.Leaf.NotBefore.Add(time.Duration(float64(validity) * renewalFraction))
+	return time.Now().After(renewAt)
+}
+
+// loadCertificate reads a previously enrolled certificate and key from CertDir, if present.
+func (e *ACMEEnroller) loadCertificate() (tls.Certificate, bool) {
+	if e.CertDir == "" {
+		return tls.Certificate{}, false
+	}
+	certPEM, err := ioutil.ReadFile(filepath.Join(e.CertDir, certFile))
+	if err != nil {
+		return tls.Certificate{}, false
+	}
+	keyPEM, err := ioutil.ReadFile(filepath.Join(e.CertDir, keyFile))
+	if err != nil {
+		return tls.Certificate{}, false
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, false
+	}
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		cert.Leaf = leaf
+	}
+	return cert, true
+}
+
+// saveCertificate persists cert to CertDir so future enrolments can be skipped until renewal.
+func (e *ACMEEnroller) saveCertificate(cert tls.Certificate) error {
+	if e.CertDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(e.CertDir, 0700); err != nil {
+		return err
+	}
+	certPEM, keyPEM, err := encodeCertificate(cert)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(e.CertDir, certFile), certPEM, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(e.CertDir, keyFile), keyPEM, 0600)
+}
@@ -0,0 +1,451 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package things
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testACMEServerMux(directoryStatus int) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(directoryStatus)
+	})
+	return mux
+}
+
+func TestCertNeedsRenewal(t *testing.T) {
+	tests := []struct {
+		name   string
+		cert   tls.Certificate
+		expect bool
+	}{
+		{name: "no-leaf", cert: tls.Certificate{}, expect: true},
+		{
+			name: "fresh",
+			cert: tls.Certificate{Leaf: &x509.Certificate{
+				NotBefore: time.Now().Add(-time.Hour),
+				NotAfter:  time.Now().Add(23 * time.Hour),
+			}},
+			expect: false,
+		},
+		{
+			name: "past-renewal-window",
+			cert: tls.Certificate{Leaf: &x509.Certificate{
+				NotBefore: time.Now().Add(-23 * time.Hour),
+				NotAfter:  time.Now().Add(-time.Hour),
+			}},
+			expect: true,
+		},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			if got := certNeedsRenewal(subtest.cert); got != subtest.expect {
+				t.Errorf("certNeedsRenewal() = %v, want %v", got, subtest.expect)
+			}
+		})
+	}
+}
+
+func TestACMEEnroller_SaveLoadCertificate(t *testing.T) {
+	dir := t.TempDir()
+	signer := testGenerateSigner()
+	selfSigned, err := publicKeyCertificate(signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(selfSigned.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	selfSigned.Leaf = leaf
+
+	e := &ACMEEnroller{CertDir: dir}
+	if err := e.saveCertificate(selfSigned); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, ok := e.loadCertificate()
+	if !ok {
+		t.Fatal("expected a certificate to be loaded")
+	}
+	if len(loaded.Certificate) != 1 || string(loaded.Certificate[0]) != string(selfSigned.Certificate[0]) {
+		t.Error("loaded certificate does not match the one saved")
+	}
+}
+
+func TestACMEEnroller_Enrol_DirectoryUnavailable(t *testing.T) {
+	server := httptest.NewServer(testACMEServerMux(http.StatusInternalServerError))
+	defer server.Close()
+
+	e := &ACMEEnroller{
+		DirectoryURL:  server.URL + "/directory",
+		Identifier:    "thing-1",
+		ChallengeType: ChallengeHTTP,
+	}
+
+	// A short caller deadline, well inside enrolTimeout, proves enrolment fails fast rather than
+	// retrying a flaky or hostile CA's 5xx responses indefinitely.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	_, err := e.Enrol(ctx, testGenerateSigner())
+	if err == nil {
+		t.Error("expected enrolment to fail when the ACME directory is unavailable")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected enrolment to fail close to the caller's deadline, took %s", elapsed)
+	}
+}
+
+// fakeACMEServer is a minimal ACME CA mux covering just enough of RFC 8555 to drive an
+// ACMEEnroller through a full order/authorization/finalize flow for one identifier, for either
+// ChallengeHTTP or ChallengeDeviceAttest. It does not verify JWS signatures: like the repo's other
+// test muxes (testAuthCOAPMux and friends), it trusts the shape of the request and asserts on the
+// parts a request would get wrong if the client under test were broken.
+type fakeACMEServer struct {
+	t             *testing.T
+	challengeType string
+
+	mu         sync.Mutex
+	authzValid bool
+	lastAttObj string
+	caKey      *ecdsa.PrivateKey
+	caCert     []byte
+	csr        *x509.CertificateRequest
+}
+
+func newFakeACMEServer(t *testing.T, challengeType string) (*httptest.Server, *fakeACMEServer) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake-acme-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caCert, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeACMEServer{t: t, challengeType: challengeType, caKey: caKey, caCert: caCert}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", s.directory)
+	mux.HandleFunc("/new-nonce", s.newNonce)
+	mux.HandleFunc("/new-acct", s.newAccount)
+	mux.HandleFunc("/new-order", s.newOrder)
+	mux.HandleFunc("/authz/1", s.authorization)
+	mux.HandleFunc("/chal/1", s.challenge)
+	mux.HandleFunc("/order/1", s.order)
+	mux.HandleFunc("/order/1/finalize", s.finalize)
+	mux.HandleFunc("/cert/1", s.certificate)
+	return httptest.NewServer(mux), s
+}
+
+func jwsPayload(r *http.Request) map[string]interface{} {
+	var msg struct {
+		Payload string `json:"payload"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&msg)
+	body, _ := base64.RawURLEncoding.DecodeString(msg.Payload)
+	var payload map[string]interface{}
+	_ = json.Unmarshal(body, &payload)
+	return payload
+}
+
+func (s *fakeACMEServer) directory(w http.ResponseWriter, r *http.Request) {
+	base := "http://" + r.Host
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"newNonce":   base + "/new-nonce",
+		"newAccount": base + "/new-acct",
+		"newOrder":   base + "/new-order",
+	})
+}
+
+func (s *fakeACMEServer) newNonce(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", "nonce-1")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *fakeACMEServer) newAccount(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", "nonce-1")
+	w.Header().Set("Location", "http://"+r.Host+"/acct/1")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "valid"})
+}
+
+func (s *fakeACMEServer) newOrder(w http.ResponseWriter, r *http.Request) {
+	base := "http://" + r.Host
+	w.Header().Set("Replay-Nonce", "nonce-1")
+	w.Header().Set("Location", base+"/order/1")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":         "pending",
+		"identifiers":    []map[string]string{{"type": "dns", "value": "thing-1"}},
+		"authorizations": []string{base + "/authz/1"},
+		"finalize":       base + "/order/1/finalize",
+	})
+}
+
+func (s *fakeACMEServer) authorization(w http.ResponseWriter, r *http.Request) {
+	base := "http://" + r.Host
+	s.mu.Lock()
+	valid := s.authzValid
+	s.mu.Unlock()
+
+	status := "pending"
+	if valid {
+		status = "valid"
+	}
+	w.Header().Set("Replay-Nonce", "nonce-1")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":     status,
+		"identifier": map[string]string{"type": "dns", "value": "thing-1"},
+		"challenges": []map[string]string{{
+			"type":   s.challengeType,
+			"url":    base + "/chal/1",
+			"token":  "token-1",
+			"status": status,
+		}},
+	})
+}
+
+func (s *fakeACMEServer) challenge(w http.ResponseWriter, r *http.Request) {
+	payload := jwsPayload(r)
+
+	s.mu.Lock()
+	switch s.challengeType {
+	case ChallengeDeviceAttest:
+		attObj, _ := payload["attObj"].(string)
+		s.lastAttObj = attObj
+		s.authzValid = attObj != ""
+	default:
+		s.authzValid = true
+	}
+	valid := s.authzValid
+	s.mu.Unlock()
+
+	status := "pending"
+	if valid {
+		status = "valid"
+	}
+	w.Header().Set("Replay-Nonce", "nonce-1")
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"type":   s.challengeType,
+		"url":    "http://" + r.Host + "/chal/1",
+		"token":  "token-1",
+		"status": status,
+	})
+}
+
+func (s *fakeACMEServer) order(w http.ResponseWriter, r *http.Request) {
+	base := "http://" + r.Host
+	s.mu.Lock()
+	valid := s.authzValid
+	hasCert := s.csr != nil
+	s.mu.Unlock()
+
+	status := "pending"
+	if hasCert {
+		status = "valid"
+	} else if valid {
+		status = "ready"
+	}
+	resp := map[string]interface{}{
+		"status":         status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": "thing-1"}},
+		"authorizations": []string{base + "/authz/1"},
+		"finalize":       base + "/order/1/finalize",
+	}
+	if hasCert {
+		resp["certificate"] = base + "/cert/1"
+	}
+	w.Header().Set("Replay-Nonce", "nonce-1")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (s *fakeACMEServer) finalize(w http.ResponseWriter, r *http.Request) {
+	payload := jwsPayload(r)
+	csrB64, _ := payload["csr"].(string)
+	der, err := base64.RawURLEncoding.DecodeString(csrB64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.csr = csr
+	s.mu.Unlock()
+
+	base := "http://" + r.Host
+	w.Header().Set("Replay-Nonce", "nonce-1")
+	w.Header().Set("Location", base+"/order/1")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":         "valid",
+		"identifiers":    []map[string]string{{"type": "dns", "value": "thing-1"}},
+		"authorizations": []string{base + "/authz/1"},
+		"finalize":       base + "/order/1/finalize",
+		"certificate":    base + "/cert/1",
+	})
+}
+
+func (s *fakeACMEServer) certificate(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	csr := s.csr
+	s.mu.Unlock()
+	if csr == nil {
+		http.Error(w, "order not finalized", http.StatusBadRequest)
+		return
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "thing-1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	caCert, err := x509.ParseCertificate(s.caCert)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	leaf, err := x509.CreateCertificate(rand.Reader, template, caCert, csr.PublicKey, s.caKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: leaf})
+	_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: s.caCert})
+}
+
+func testACMEEnrolerKey(t *testing.T) crypto.Signer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestACMEEnroller_Enrol_HTTP01(t *testing.T) {
+	server, _ := newFakeACMEServer(t, ChallengeHTTP)
+	defer server.Close()
+
+	var gotToken, gotKeyAuth string
+	e := &ACMEEnroller{
+		DirectoryURL:  server.URL + "/directory",
+		Identifier:    "thing-1",
+		ChallengeType: ChallengeHTTP,
+		RespondHTTP01: func(token, keyAuthorization string) error {
+			gotToken, gotKeyAuth = token, keyAuthorization
+			return nil
+		},
+	}
+
+	cert, err := e.Enrol(context.Background(), testACMEEnrolerKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.Certificate) == 0 {
+		t.Fatal("expected a non-empty certificate chain")
+	}
+	if gotToken == "" || gotKeyAuth == "" {
+		t.Error("expected RespondHTTP01 to have been invoked with a token and key authorization")
+	}
+}
+
+func TestACMEEnroller_Enrol_DeviceAttest01(t *testing.T) {
+	server, fake := newFakeACMEServer(t, ChallengeDeviceAttest)
+	defer server.Close()
+
+	var gotKey crypto.Signer
+	thingKey := testACMEEnrolerKey(t)
+	e := &ACMEEnroller{
+		DirectoryURL:  server.URL + "/directory",
+		Identifier:    "thing-1",
+		ChallengeType: ChallengeDeviceAttest,
+		AttestationStatement: func(key crypto.Signer) ([]byte, error) {
+			gotKey = key
+			return []byte("fake-attestation-object"), nil
+		},
+	}
+
+	cert, err := e.Enrol(context.Background(), thingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.Certificate) == 0 {
+		t.Fatal("expected a non-empty certificate chain")
+	}
+	if gotKey != thingKey {
+		t.Error("expected AttestationStatement to be called with the Thing's own key")
+	}
+
+	wantAttObj := base64.RawURLEncoding.EncodeToString([]byte("fake-attestation-object"))
+	fake.mu.Lock()
+	gotAttObj := fake.lastAttObj
+	fake.mu.Unlock()
+	if gotAttObj != wantAttObj {
+		t.Errorf("expected the CA to receive the attestation object %q, got %q", wantAttObj, gotAttObj)
+	}
+}
+
+func TestACMEEnroller_Enrol_DeviceAttest01_MissingStatement(t *testing.T) {
+	server, _ := newFakeACMEServer(t, ChallengeDeviceAttest)
+	defer server.Close()
+
+	e := &ACMEEnroller{
+		DirectoryURL:  server.URL + "/directory",
+		Identifier:    "thing-1",
+		ChallengeType: ChallengeDeviceAttest,
+	}
+	if _, err := e.Enrol(context.Background(), testACMEEnrolerKey(t)); err == nil {
+		t.Error("expected enrolment to fail without an AttestationStatement func")
+	}
+}
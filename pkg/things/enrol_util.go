@@ -0,0 +1,71 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package things
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+)
+
+// errUnsupportedKeyType is returned when persisting a certificate whose private key is not an
+// ECDSA key, the only key type GatewayClient currently issues.
+var errUnsupportedKeyType = errors.New("things: unsupported private key type")
+
+// acmeAccountKey generates the key pair an ACMEEnroller uses to register with the CA. It is
+// distinct from the Thing's own identity key, matching the ACME account/certificate-key split.
+func acmeAccountKey() (crypto.Signer, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// certificateRequest builds a PKCS#10 CSR for key with commonName as its subject.
+func certificateRequest(key crypto.Signer, commonName string) ([]byte, error) {
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: commonName},
+	}
+	return x509.CreateCertificateRequest(rand.Reader, template, key)
+}
+
+// encodeCertificate PEM-encodes cert's chain and private key for storage on disk.
+func encodeCertificate(cert tls.Certificate) (certPEM, keyPEM []byte, err error) {
+	var certBuf bytes.Buffer
+	for _, der := range cert.Certificate {
+		if err := pem.Encode(&certBuf, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+			return nil, nil, err
+		}
+	}
+	ecKey, ok := cert.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, errUnsupportedKeyType
+	}
+	der, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	var keyBuf bytes.Buffer
+	if err := pem.Encode(&keyBuf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}); err != nil {
+		return nil, nil, err
+	}
+	return certBuf.Bytes(), keyBuf.Bytes(), nil
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package things
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-ocf/go-coap"
+)
+
+// introspection is the token metadata returned by the /introspect resource.
+type introspection struct {
+	Active bool   `json:"active"`
+	Exp    int64  `json:"exp"`
+	Scope  string `json:"scope"`
+	Sub    string `json:"sub"`
+	Aud    string `json:"aud"`
+}
+
+// introspect checks the validity of token via the /introspect resource. A result cached from a
+// previous call within CacheExpiration is returned without a CoAP round-trip.
+func (c *GatewayClient) introspect(token string) (introspection, error) {
+	key := cacheKey("introspect", token)
+	if v, ok := c.tokenCache().get(key); ok {
+		return v.(introspection), nil
+	}
+
+	var result introspection
+	resp, err := c.conn.Post("/introspect", coap.TextPlain, bytes.NewReader([]byte(token)))
+	if err != nil {
+		return result, err
+	}
+	if !successCode(resp.Code()) {
+		return result, fmt.Errorf("things: introspect request failed with code %s", resp.Code())
+	}
+	if err := json.Unmarshal(resp.Payload(), &result); err != nil {
+		return result, fmt.Errorf("things: failed to parse introspect response: %w", err)
+	}
+	c.tokenCache().put(key, result)
+	return result, nil
+}
+
+// invalidateIntrospection removes any cached introspection result for token, forcing the next
+// introspect call to make a fresh CoAP round-trip.
+func (c *GatewayClient) invalidateIntrospection(token string) {
+	c.tokenCache().invalidate(cacheKey("introspect", token))
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package things
+
+import (
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+	"sync/atomic"
+	"testing"
+)
+
+// testCountingCOAPMux registers a handler at path that always returns response, and increments
+// hits once per request received.
+func testCountingCOAPMux(path string, code codes.Code, response []byte, hits *int32) (mux *coap.ServeMux) {
+	mux = coap.NewServeMux()
+	mux.HandleFunc(path, func(w coap.ResponseWriter, r *coap.Request) {
+		atomic.AddInt32(hits, 1)
+		w.SetCode(code)
+		w.Write(response)
+		return
+	})
+	return mux
+}
+
+func TestGatewayClient_Introspect_Caching(t *testing.T) {
+	cert, _ := publicKeyCertificate(testGenerateSigner())
+	b := []byte(`{"active":true,"exp":9999999999,"scope":"publish","sub":"thing-1","aud":"gateway"}`)
+	var hits int32
+
+	server := testCOAPServer{config: dtlsServerConfig(cert), mux: testCountingCOAPMux("/introspect", codes.Content, b, &hits)}
+	addr, cancel, err := server.Start()
+	defer cancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &GatewayClient{Address: addr, Key: testGenerateSigner()}
+	if err := client.initialise(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		result, err := client.introspect("a-token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Active {
+			t.Error("expected an active token")
+		}
+	}
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Errorf("expected a single CoAP round-trip, got %d", got)
+	}
+
+	client.invalidateIntrospection("a-token")
+	if _, err := client.introspect("a-token"); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&hits); got != 2 {
+		t.Errorf("expected a second CoAP round-trip after invalidation, got %d", got)
+	}
+}
+
+func TestGatewayClient_Introspect_Inactive(t *testing.T) {
+	cert, _ := publicKeyCertificate(testGenerateSigner())
+	b := []byte(`{"active":false}`)
+	var hits int32
+
+	server := testCOAPServer{config: dtlsServerConfig(cert), mux: testCountingCOAPMux("/introspect", codes.Content, b, &hits)}
+	addr, cancel, err := server.Start()
+	defer cancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &GatewayClient{Address: addr, Key: testGenerateSigner()}
+	if err := client.initialise(); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := client.introspect("revoked-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Active {
+		t.Error("expected the token to be reported inactive")
+	}
+}
+
+func TestGatewayClient_AccessToken_Caching(t *testing.T) {
+	cert, _ := publicKeyCertificate(testGenerateSigner())
+	var hits int32
+
+	server := testCOAPServer{config: dtlsServerConfig(cert), mux: testCountingCOAPMux("/accesstoken", codes.Changed, []byte("{}"), &hits)}
+	addr, cancel, err := server.Start()
+	defer cancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &GatewayClient{Address: addr, Key: testGenerateSigner()}
+	if err := client.initialise(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.accessToken("publish", "gateway", applicationJOSE, "signedJWT"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Errorf("expected a single CoAP round-trip for repeated (scope, audience), got %d", got)
+	}
+
+	if _, err := client.accessToken("other-scope", "gateway", applicationJOSE, "signedJWT"); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&hits); got != 2 {
+		t.Errorf("expected a fresh round-trip for a different scope, got %d", got)
+	}
+}
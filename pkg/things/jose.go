@@ -0,0 +1,58 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package things
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// signJWS signs claims as a compact JWS using key, producing the application/jose payload the
+// Gateway expects on /accesstoken, /sshcert and similar resources.
+func signJWS(key crypto.Signer, claims interface{}) (string, error) {
+	alg, err := signingAlgorithm(key)
+	if err != nil {
+		return "", err
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, nil)
+	if err != nil {
+		return "", fmt.Errorf("things: failed to create JWS signer: %w", err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	sig, err := signer.Sign(payload)
+	if err != nil {
+		return "", fmt.Errorf("things: failed to sign JWS: %w", err)
+	}
+	return sig.CompactSerialize()
+}
+
+// signingAlgorithm picks the JWS algorithm matching key's type.
+func signingAlgorithm(key crypto.Signer) (jose.SignatureAlgorithm, error) {
+	switch key.Public().(type) {
+	case *ecdsa.PublicKey:
+		return jose.ES256, nil
+	default:
+		return "", fmt.Errorf("things: unsupported signing key type %T", key.Public())
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package things
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultCacheExpiration is how long a GatewayClient caches introspection results and freshly
+// issued access tokens when CacheExpiration is left unset.
+const defaultCacheExpiration = 30 * time.Second
+
+// defaultCacheCapacity bounds the number of distinct tokens a tokenCache holds at once.
+const defaultCacheCapacity = 256
+
+// tokenCache is a small in-process LRU cache, keyed by a hash of a token or a (scope, audience)
+// tuple, used to avoid repeat CoAP round-trips for introspection and access token requests.
+type tokenCache struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+// cacheEntry is the value stored in a tokenCache's backing list.
+type cacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// newTokenCache returns a tokenCache whose entries expire after ttl.
+func newTokenCache(ttl time.Duration) *tokenCache {
+	return &tokenCache{
+		ttl:      ttl,
+		capacity: defaultCacheCapacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// get returns the cached value for key, if present and not yet expired.
+func (c *tokenCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.removeLocked(elem)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.value, true
+}
+
+// put inserts or refreshes the cached value for key, evicting the least recently used entry if
+// the cache is at capacity.
+func (c *tokenCache) put(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*cacheEntry).value = value
+		elem.Value.(*cacheEntry).expires = time.Now().Add(c.ttl)
+		c.order.MoveToFront(elem)
+		return
+	}
+	elem := c.order.PushFront(&cacheEntry{key: key, value: value, expires: time.Now().Add(c.ttl)})
+	c.entries[key] = elem
+	for c.order.Len() > c.capacity {
+		c.removeLocked(c.order.Back())
+	}
+}
+
+// invalidate removes key from the cache, if present.
+func (c *tokenCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.removeLocked(elem)
+	}
+}
+
+// removeLocked removes elem from the cache. The caller must hold c.mu.
+func (c *tokenCache) removeLocked(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
+
+// cacheKey hashes its parts into a single opaque cache key, so that neither raw tokens nor scopes
+// are held in the cache's key space in the clear.
+func cacheKey(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,202 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package things
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// oauth2DeviceCodeCallbackType is the AM authentication tree callback type satisfied by
+// OAuth2DeviceCodeCallback.
+const oauth2DeviceCodeCallbackType = "OAuth2DeviceCodeCallback"
+
+// defaultDevicePollInterval is used when a device authorization response omits an interval.
+const defaultDevicePollInterval = 5 * time.Second
+
+// OAuth2DeviceCodeCallback satisfies an AM callback by running the OAuth 2.0 device authorization
+// grant (RFC 8628): it requests a device code, shows the user a verification URL and code via
+// DisplayUserCode, then polls the token endpoint until the user has approved the request on a
+// second screen.
+type OAuth2DeviceCodeCallback struct {
+	// DeviceAuthorizationURL is the IdP's device authorization endpoint.
+	DeviceAuthorizationURL string
+	// TokenURL is the IdP's token endpoint.
+	TokenURL string
+	// ClientID identifies the Thing to the IdP.
+	ClientID string
+	// Scope is the space-separated list of scopes requested.
+	Scope string
+	// DisplayUserCode is called once a device code has been issued, so the caller can show the
+	// verification URL and user code to whoever is authorizing the Thing.
+	DisplayUserCode func(verificationURI, userCode string)
+	// HTTPClient is used to call the IdP. http.DefaultClient is used if nil.
+	HTTPClient *http.Client
+	// PollInterval overrides the token endpoint poll interval, taking precedence over both the
+	// IdP's advertised interval and defaultDevicePollInterval. Tests use this to avoid waiting out
+	// real IdP-scale intervals.
+	PollInterval time.Duration
+}
+
+// deviceAuthorizationResponse is the RFC 8628 section 3.2 response.
+type deviceAuthorizationResponse struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+}
+
+// deviceTokenResponse is the token endpoint's response, successful or not.
+type deviceTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+	TokenType   string `json:"token_type"`
+	Error       string `json:"error"`
+}
+
+// Handles reports whether cb is an OAuth2DeviceCodeCallback.
+func (h *OAuth2DeviceCodeCallback) Handles(cb callback) bool {
+	return cb.Type == oauth2DeviceCodeCallbackType
+}
+
+// Handle runs the device authorization grant to completion and returns cb with the resulting
+// token in its Input.
+func (h *OAuth2DeviceCodeCallback) Handle(ctx context.Context, cb callback) (callback, error) {
+	client := h.httpClient()
+
+	authResp, err := h.requestDeviceCode(ctx, client)
+	if err != nil {
+		return cb, fmt.Errorf("things: device authorization request failed: %w", err)
+	}
+	if h.DisplayUserCode != nil {
+		h.DisplayUserCode(authResp.VerificationURI, authResp.UserCode)
+	}
+
+	token, err := h.pollToken(ctx, client, authResp)
+	if err != nil {
+		return cb, err
+	}
+
+	cb.Input = []callbackEntry{{Name: "token", Value: token}}
+	return cb, nil
+}
+
+func (h *OAuth2DeviceCodeCallback) httpClient() *http.Client {
+	if h.HTTPClient != nil {
+		return h.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (h *OAuth2DeviceCodeCallback) requestDeviceCode(ctx context.Context, client *http.Client) (deviceAuthorizationResponse, error) {
+	var authResp deviceAuthorizationResponse
+	form := url.Values{"client_id": {h.ClientID}}
+	if h.Scope != "" {
+		form.Set("scope", h.Scope)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.DeviceAuthorizationURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return authResp, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return authResp, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return authResp, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&authResp); err != nil {
+		return authResp, err
+	}
+	if authResp.Interval == 0 {
+		authResp.Interval = int(defaultDevicePollInterval / time.Second)
+	}
+	return authResp, nil
+}
+
+// pollToken polls TokenURL with device_code until the user has authorized the request, the
+// request expires, or ctx is cancelled.
+func (h *OAuth2DeviceCodeCallback) pollToken(ctx context.Context, client *http.Client, authResp deviceAuthorizationResponse) (string, error) {
+	interval := time.Duration(authResp.Interval) * time.Second
+	if h.PollInterval > 0 {
+		interval = h.PollInterval
+	}
+	deadline := time.Now().Add(time.Duration(authResp.ExpiresIn) * time.Second)
+
+	for {
+		if authResp.ExpiresIn > 0 && time.Now().After(deadline) {
+			return "", fmt.Errorf("things: device code expired before the user authorized it")
+		}
+
+		token, pending, err := h.requestToken(ctx, client, authResp.DeviceCode)
+		if err != nil {
+			return "", err
+		}
+		if !pending {
+			return token, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// requestToken makes one token endpoint poll. pending is true if the IdP is still waiting on the user.
+func (h *OAuth2DeviceCodeCallback) requestToken(ctx context.Context, client *http.Client, deviceCode string) (token string, pending bool, err error) {
+	form := url.Values{
+		"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+		"device_code": {deviceCode},
+		"client_id":   {h.ClientID},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+
+	var tokenResp deviceTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", false, err
+	}
+	switch tokenResp.Error {
+	case "":
+		if tokenResp.IDToken != "" {
+			return tokenResp.IDToken, false, nil
+		}
+		return tokenResp.AccessToken, false, nil
+	case "authorization_pending", "slow_down":
+		return "", true, nil
+	default:
+		return "", false, fmt.Errorf("things: device token request failed: %s", tokenResp.Error)
+	}
+}
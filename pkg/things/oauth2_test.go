@@ -0,0 +1,105 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package things
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testDeviceCodeServer stubs the device authorization and token endpoints of an OAuth 2.0 IdP.
+// The token endpoint reports authorization_pending for the first pendingPolls polls, then succeeds.
+func testDeviceCodeServer(t *testing.T, pendingPolls int) *httptest.Server {
+	t.Helper()
+	polls := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(deviceAuthorizationResponse{
+			DeviceCode:      "devicecode",
+			UserCode:        "USER-CODE",
+			VerificationURI: "https://idp.example.com/device",
+			ExpiresIn:       60,
+			Interval:        0,
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if polls < pendingPolls {
+			polls++
+			_ = json.NewEncoder(w).Encode(deviceTokenResponse{Error: "authorization_pending"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(deviceTokenResponse{AccessToken: "the-access-token"})
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestOAuth2DeviceCodeCallback_Handle(t *testing.T) {
+	server := testDeviceCodeServer(t, 2)
+	defer server.Close()
+
+	var shownCode string
+	h := &OAuth2DeviceCodeCallback{
+		DeviceAuthorizationURL: server.URL + "/device",
+		TokenURL:               server.URL + "/token",
+		ClientID:               "thing-1",
+		DisplayUserCode: func(verificationURI, userCode string) {
+			shownCode = userCode
+		},
+		PollInterval: time.Millisecond,
+	}
+
+	if !h.Handles(callback{Type: oauth2DeviceCodeCallbackType}) {
+		t.Fatal("expected Handles to match its own callback type")
+	}
+
+	cb, err := h.Handle(context.Background(), callback{Type: oauth2DeviceCodeCallbackType})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shownCode != "USER-CODE" {
+		t.Errorf("expected the user code to be surfaced, got %q", shownCode)
+	}
+	if len(cb.Input) != 1 || cb.Input[0].Value != "the-access-token" {
+		t.Errorf("expected the polled access token in the callback input, got %+v", cb.Input)
+	}
+}
+
+func TestOAuth2DeviceCodeCallback_Handle_Denied(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(deviceAuthorizationResponse{DeviceCode: "devicecode", ExpiresIn: 60})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(deviceTokenResponse{Error: "access_denied"})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	h := &OAuth2DeviceCodeCallback{
+		DeviceAuthorizationURL: server.URL + "/device",
+		TokenURL:               server.URL + "/token",
+		ClientID:               "thing-1",
+	}
+	_, err := h.Handle(context.Background(), callback{Type: oauth2DeviceCodeCallbackType})
+	if err == nil {
+		t.Error("expected an error when the IdP reports access_denied")
+	}
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package things
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// oidcIDTokenCallbackType is the AM authentication tree callback type satisfied by
+// OIDCIDTokenCallback.
+const oidcIDTokenCallbackType = "OIDCIDTokenCallback"
+
+// OIDCIDTokenCallback satisfies an AM callback by presenting an ID token obtained out-of-band
+// from an OIDC issuer (e.g. Google, GitHub, or a corporate IdP), validating its signature against
+// the issuer's published JWKS before handing it to AM.
+type OIDCIDTokenCallback struct {
+	// JWKSURL is the issuer's JSON Web Key Set endpoint.
+	JWKSURL string
+	// IDToken is the pre-obtained, compact-serialized ID token to present.
+	IDToken string
+	// Issuer, if set, is the expected "iss" claim; ID tokens from any other issuer are rejected.
+	Issuer string
+	// Audience, if set, is the expected "aud" claim; ID tokens not scoped to this audience are
+	// rejected.
+	Audience string
+	// HTTPClient is used to fetch the JWKS. http.DefaultClient is used if nil.
+	HTTPClient *http.Client
+}
+
+// Handles reports whether cb is an OIDCIDTokenCallback.
+func (h *OIDCIDTokenCallback) Handles(cb callback) bool {
+	return cb.Type == oidcIDTokenCallbackType
+}
+
+// Handle validates IDToken against the issuer's JWKS and, if valid, returns cb with the token in
+// its Input for AM to verify independently.
+func (h *OIDCIDTokenCallback) Handle(ctx context.Context, cb callback) (callback, error) {
+	if h.IDToken == "" {
+		return cb, fmt.Errorf("things: OIDCIDTokenCallback requires an IDToken")
+	}
+	if err := h.verify(ctx); err != nil {
+		return cb, fmt.Errorf("things: ID token validation failed: %w", err)
+	}
+	cb.Input = []callbackEntry{{Name: "id_token", Value: h.IDToken}}
+	return cb, nil
+}
+
+// verify checks IDToken's signature against a key published in the issuer's JWKS, then validates
+// its standard claims so an expired or wrongly-scoped token can't be forwarded to AM as valid.
+func (h *OIDCIDTokenCallback) verify(ctx context.Context) error {
+	sig, err := jose.ParseSigned(h.IDToken)
+	if err != nil {
+		return fmt.Errorf("failed to parse ID token: %w", err)
+	}
+
+	keys, err := h.fetchJWKS(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+
+	var payload []byte
+	for _, key := range keys.Keys {
+		if p, err := sig.Verify(key.Key); err == nil {
+			payload = p
+			break
+		}
+	}
+	if payload == nil {
+		return fmt.Errorf("no JWKS key matched the ID token's signature")
+	}
+	return h.validateClaims(payload)
+}
+
+// validateClaims enforces the standard claims that matter for a federated credential: a token that
+// has expired, or that wasn't issued for this issuer/audience, must not be accepted just because its
+// signature checks out.
+func (h *OIDCIDTokenCallback) validateClaims(payload []byte) error {
+	var claims struct {
+		Issuer   string       `json:"iss"`
+		Audience oidcAudience `json:"aud"`
+		Expiry   int64        `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return fmt.Errorf("failed to parse ID token claims: %w", err)
+	}
+	if claims.Expiry != 0 && time.Unix(claims.Expiry, 0).Before(time.Now()) {
+		return fmt.Errorf("ID token expired at %s", time.Unix(claims.Expiry, 0))
+	}
+	if h.Issuer != "" && claims.Issuer != h.Issuer {
+		return fmt.Errorf("ID token issuer %q does not match expected issuer %q", claims.Issuer, h.Issuer)
+	}
+	if h.Audience != "" && !claims.Audience.contains(h.Audience) {
+		return fmt.Errorf("ID token audience does not contain expected audience %q", h.Audience)
+	}
+	return nil
+}
+
+// oidcAudience unmarshals the "aud" claim, which RFC 7519 permits as either a single string or an
+// array of strings.
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = oidcAudience{single}
+		return nil
+	}
+	var multi []string
+	if err := json.Unmarshal(data, &multi); err != nil {
+		return err
+	}
+	*a = multi
+	return nil
+}
+
+func (a oidcAudience) contains(v string) bool {
+	for _, s := range a {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *OIDCIDTokenCallback) fetchJWKS(ctx context.Context) (jose.JSONWebKeySet, error) {
+	var keys jose.JSONWebKeySet
+	client := h.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.JWKSURL, nil)
+	if err != nil {
+		return keys, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return keys, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return keys, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+		return keys, err
+	}
+	return keys, nil
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package things
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+func testOIDCIssuer(t *testing.T, key interface{}, kid string) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		jwk := jose.JSONWebKey{Key: key, KeyID: kid, Algorithm: string(jose.ES256), Use: "sig"}
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{jwk.Public()}})
+	})
+	return httptest.NewServer(mux)
+}
+
+func testSignIDToken(t *testing.T, key interface{}, kid string) string {
+	t.Helper()
+	return testSignIDTokenClaims(t, key, kid, `{"sub":"thing-1"}`)
+}
+
+func testSignIDTokenClaims(t *testing.T, key interface{}, kid, claims string) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, &jose.SignerOptions{
+		ExtraHeaders: map[jose.HeaderKey]interface{}{"kid": kid},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := signer.Sign([]byte(claims))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := sig.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestOIDCIDTokenCallback_Handle(t *testing.T) {
+	key := testGenerateSigner()
+	issuer := testOIDCIssuer(t, key, "key-1")
+	defer issuer.Close()
+	idToken := testSignIDToken(t, key, "key-1")
+
+	h := &OIDCIDTokenCallback{JWKSURL: issuer.URL + "/jwks.json", IDToken: idToken}
+	if !h.Handles(callback{Type: oidcIDTokenCallbackType}) {
+		t.Fatal("expected Handles to match its own callback type")
+	}
+
+	cb, err := h.Handle(context.Background(), callback{Type: oidcIDTokenCallbackType})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cb.Input) != 1 || cb.Input[0].Value != idToken {
+		t.Errorf("expected the ID token in the callback input, got %+v", cb.Input)
+	}
+}
+
+func TestOIDCIDTokenCallback_Handle_WrongKey(t *testing.T) {
+	signingKey := testGenerateSigner()
+	otherKey := testGenerateSigner()
+	issuer := testOIDCIssuer(t, otherKey.Public(), "key-1")
+	defer issuer.Close()
+	idToken := testSignIDToken(t, signingKey, "key-1")
+
+	h := &OIDCIDTokenCallback{JWKSURL: issuer.URL + "/jwks.json", IDToken: idToken}
+	if _, err := h.Handle(context.Background(), callback{Type: oidcIDTokenCallbackType}); err == nil {
+		t.Error("expected validation to fail against a JWKS that does not contain the signing key")
+	}
+}
+
+func TestOIDCIDTokenCallback_Handle_Expired(t *testing.T) {
+	key := testGenerateSigner()
+	issuer := testOIDCIssuer(t, key, "key-1")
+	defer issuer.Close()
+	claims := fmt.Sprintf(`{"sub":"thing-1","exp":%d}`, time.Now().Add(-time.Hour).Unix())
+	idToken := testSignIDTokenClaims(t, key, "key-1", claims)
+
+	h := &OIDCIDTokenCallback{JWKSURL: issuer.URL + "/jwks.json", IDToken: idToken}
+	if _, err := h.Handle(context.Background(), callback{Type: oidcIDTokenCallbackType}); err == nil {
+		t.Error("expected validation to fail against an expired ID token")
+	}
+}
+
+func TestOIDCIDTokenCallback_Handle_WrongAudience(t *testing.T) {
+	key := testGenerateSigner()
+	issuer := testOIDCIssuer(t, key, "key-1")
+	defer issuer.Close()
+	claims := fmt.Sprintf(`{"sub":"thing-1","exp":%d,"aud":"other-client"}`, time.Now().Add(time.Hour).Unix())
+	idToken := testSignIDTokenClaims(t, key, "key-1", claims)
+
+	h := &OIDCIDTokenCallback{JWKSURL: issuer.URL + "/jwks.json", IDToken: idToken, Audience: "thing-client"}
+	if _, err := h.Handle(context.Background(), callback{Type: oidcIDTokenCallbackType}); err == nil {
+		t.Error("expected validation to fail against an ID token minted for a different audience")
+	}
+}
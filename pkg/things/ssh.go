@@ -0,0 +1,147 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package things
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHOptions configures a certificate requested via Thing.RequestSSHCertificate.
+type SSHOptions struct {
+	// Principals lists the user or host names the certificate is valid for.
+	Principals []string
+	// ValidAfter and ValidBefore bound the certificate's validity period. The zero value of
+	// ValidBefore requests the CA's default lifetime.
+	ValidAfter, ValidBefore time.Time
+	// HostCert requests a host certificate rather than a user certificate.
+	HostCert bool
+}
+
+// sshCertificateRequest is the claim set signed and posted to /sshcert.
+type sshCertificateRequest struct {
+	PublicKey   string   `json:"publicKey"`
+	Principals  []string `json:"principals"`
+	ValidAfter  uint64   `json:"validAfter"`
+	ValidBefore uint64   `json:"validBefore"`
+	HostCert    bool     `json:"hostCert"`
+}
+
+// sshCAKeys is the response returned by /sshcakeys.
+type sshCAKeys struct {
+	UserCAKeys []string `json:"userCAKeys"`
+	HostCAKeys []string `json:"hostCAKeys"`
+}
+
+// sshCertificate posts a signed SSH certificate request to /sshcert and parses the resulting
+// ssh.Certificate from the response.
+func (c *GatewayClient) sshCertificate(signedJWT string) (*ssh.Certificate, error) {
+	resp, err := c.conn.Post("/sshcert", applicationJOSE, bytes.NewReader([]byte(signedJWT)))
+	if err != nil {
+		return nil, err
+	}
+	if !successCode(resp.Code()) {
+		return nil, fmt.Errorf("things: SSH certificate request failed with code %s", resp.Code())
+	}
+	pub, err := ssh.ParsePublicKey(resp.Payload())
+	if err != nil {
+		return nil, fmt.Errorf("things: failed to parse SSH certificate response: %w", err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("things: gateway response was not an SSH certificate")
+	}
+	return cert, nil
+}
+
+// sshHostKeys fetches AM's trusted SSH CA keys from /sshcakeys.
+func (c *GatewayClient) sshHostKeys() (sshCAKeys, error) {
+	var keys sshCAKeys
+	resp, err := c.conn.Get("/sshcakeys")
+	if err != nil {
+		return keys, err
+	}
+	if !successCode(resp.Code()) {
+		return keys, fmt.Errorf("things: SSH CA key request failed with code %s", resp.Code())
+	}
+	if err := json.Unmarshal(resp.Payload(), &keys); err != nil {
+		return keys, fmt.Errorf("things: failed to parse SSH CA key response: %w", err)
+	}
+	return keys, nil
+}
+
+// RequestSSHCertificate asks the Gateway to sign key with the AM SSH CA, returning a certificate
+// valid for the principals and role described by opts.
+func (t *Thing) RequestSSHCertificate(key ssh.PublicKey, opts SSHOptions) (*ssh.Certificate, error) {
+	req := sshCertificateRequest{
+		PublicKey:  base64.StdEncoding.EncodeToString(key.Marshal()),
+		Principals: opts.Principals,
+		HostCert:   opts.HostCert,
+	}
+	if !opts.ValidAfter.IsZero() {
+		req.ValidAfter = uint64(opts.ValidAfter.Unix())
+	}
+	if !opts.ValidBefore.IsZero() {
+		req.ValidBefore = uint64(opts.ValidBefore.Unix())
+	}
+
+	jws, err := signJWS(t.gateway.Key, req)
+	if err != nil {
+		return nil, fmt.Errorf("things: failed to sign SSH certificate request: %w", err)
+	}
+	return t.gateway.sshCertificate(jws)
+}
+
+// SSHHostKeys returns the trusted user and host CA public keys AM issues SSH certificates with,
+// so the Thing can populate its TrustedUserCAKeys file and known_hosts file respectively.
+func (t *Thing) SSHHostKeys() (userCAKeys, hostCAKeys []ssh.PublicKey, err error) {
+	keys, err := t.gateway.sshHostKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+	userCAKeys, err = parseSSHPublicKeys(keys.UserCAKeys)
+	if err != nil {
+		return nil, nil, err
+	}
+	hostCAKeys, err = parseSSHPublicKeys(keys.HostCAKeys)
+	if err != nil {
+		return nil, nil, err
+	}
+	return userCAKeys, hostCAKeys, nil
+}
+
+// parseSSHPublicKeys decodes a list of base64-encoded SSH wire-format public keys.
+func parseSSHPublicKeys(encoded []string) ([]ssh.PublicKey, error) {
+	keys := make([]ssh.PublicKey, 0, len(encoded))
+	for _, e := range encoded {
+		raw, err := base64.StdEncoding.DecodeString(e)
+		if err != nil {
+			return nil, fmt.Errorf("things: failed to decode SSH CA key: %w", err)
+		}
+		key, err := ssh.ParsePublicKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("things: failed to parse SSH CA key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,268 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package things
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+	"golang.org/x/crypto/ssh"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+func testSSHCertCOAPMux(code codes.Code, response []byte) (mux *coap.ServeMux) {
+	mux = coap.NewServeMux()
+	mux.HandleFunc("/sshcert", func(w coap.ResponseWriter, r *coap.Request) {
+		w.SetCode(code)
+		w.Write(response)
+		return
+	})
+	return mux
+}
+
+// testMarshalledSSHCertificate returns a user ssh.Certificate, signed by a throwaway CA key,
+// marshalled in SSH wire format, as a Gateway would return it.
+func testMarshalledSSHCertificate(t *testing.T) []byte {
+	t.Helper()
+	signerKey, err := ssh.NewSignerFromKey(testGenerateSigner())
+	if err != nil {
+		t.Fatal(err)
+	}
+	subjectKey, err := ssh.NewPublicKey(testGenerateSigner().Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{
+		Key:             subjectKey,
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"thing"},
+	}
+	if err := cert.SignCert(rand.Reader, signerKey); err != nil {
+		t.Fatal(err)
+	}
+	return cert.Marshal()
+}
+
+func testGatewayClientSSHCertificate(client *GatewayClient, server *testCOAPServer) (err error) {
+	if server != nil {
+		var cancel func()
+		client.Address, cancel, err = server.Start()
+		if err != nil {
+			panic(err)
+		}
+		defer cancel()
+	}
+
+	err = client.initialise()
+	if err != nil {
+		return err
+	}
+	_, err = client.sshCertificate("signedJWT")
+	return err
+}
+
+func TestGatewayClient_SSHCertificate(t *testing.T) {
+	cert, _ := publicKeyCertificate(testGenerateSigner())
+	sshCert := testMarshalledSSHCertificate(t)
+
+	tests := []struct {
+		name       string
+		successful bool
+		client     *GatewayClient
+		server     *testCOAPServer
+	}{
+		{name: "success", successful: true, client: &GatewayClient{Key: testGenerateSigner()},
+			server: &testCOAPServer{config: dtlsServerConfig(cert), mux: testSSHCertCOAPMux(codes.Changed, sshCert)}},
+		{name: "unexpected-code", client: &GatewayClient{Key: testGenerateSigner()},
+			server: &testCOAPServer{config: dtlsServerConfig(cert), mux: testSSHCertCOAPMux(codes.BadGateway, sshCert)}},
+		{name: "invalid-payload", client: &GatewayClient{Key: testGenerateSigner()},
+			server: &testCOAPServer{config: dtlsServerConfig(cert), mux: testSSHCertCOAPMux(codes.Changed, []byte("aaaa"))}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			err := testGatewayClientSSHCertificate(subtest.client, subtest.server)
+			if subtest.successful && err != nil {
+				t.Error(err)
+			}
+			if !subtest.successful && err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
+// testSSHCertClaimsCOAPMux handles /sshcert by decoding the posted JWS's claims - without
+// verifying its signature, which is the Gateway's job, not this mux's - and asserting they equal
+// want, then returns a certificate for the request's own public key.
+func testSSHCertClaimsCOAPMux(t *testing.T, want sshCertificateRequest) *coap.ServeMux {
+	t.Helper()
+	mux := coap.NewServeMux()
+	mux.HandleFunc("/sshcert", func(w coap.ResponseWriter, r *coap.Request) {
+		sig, err := jose.ParseSigned(string(r.Msg.Payload()))
+		if err != nil {
+			t.Errorf("failed to parse posted JWS: %v", err)
+			w.SetCode(codes.BadRequest)
+			return
+		}
+		var got sshCertificateRequest
+		if err := json.Unmarshal(sig.UnsafePayloadWithoutVerification(), &got); err != nil {
+			t.Errorf("failed to parse posted SSH certificate claims: %v", err)
+			w.SetCode(codes.BadRequest)
+			return
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("posted SSH certificate claims = %+v, want %+v", got, want)
+		}
+
+		subjectKeyBytes, err := base64.StdEncoding.DecodeString(got.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subjectKey, err := ssh.ParsePublicKey(subjectKeyBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certType := uint32(ssh.UserCert)
+		if got.HostCert {
+			certType = ssh.HostCert
+		}
+		signerKey, err := ssh.NewSignerFromKey(testGenerateSigner())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert := &ssh.Certificate{
+			Key:             subjectKey,
+			CertType:        certType,
+			ValidPrincipals: got.Principals,
+		}
+		if err := cert.SignCert(rand.Reader, signerKey); err != nil {
+			t.Fatal(err)
+		}
+		w.SetCode(codes.Changed)
+		w.Write(cert.Marshal())
+	})
+	return mux
+}
+
+func TestThing_RequestSSHCertificate(t *testing.T) {
+	cert, _ := publicKeyCertificate(testGenerateSigner())
+
+	subjectKey, err := ssh.NewPublicKey(testGenerateSigner().Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := SSHOptions{
+		Principals:  []string{"thing-1"},
+		ValidAfter:  time.Unix(1000, 0),
+		ValidBefore: time.Unix(2000, 0),
+		HostCert:    true,
+	}
+	want := sshCertificateRequest{
+		PublicKey:   base64.StdEncoding.EncodeToString(subjectKey.Marshal()),
+		Principals:  opts.Principals,
+		ValidAfter:  1000,
+		ValidBefore: 2000,
+		HostCert:    true,
+	}
+
+	server := &testCOAPServer{config: dtlsServerConfig(cert), mux: testSSHCertClaimsCOAPMux(t, want)}
+	addr, cancel, err := server.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	gateway := &GatewayClient{Address: addr, Key: testGenerateSigner()}
+	if err := gateway.initialise(); err != nil {
+		t.Fatal(err)
+	}
+	thing := NewThing(gateway)
+
+	got, err := thing.RequestSSHCertificate(subjectKey, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.ValidPrincipals) != 1 || got.ValidPrincipals[0] != "thing-1" {
+		t.Errorf("expected the returned certificate's principals to be [thing-1], got %v", got.ValidPrincipals)
+	}
+	if got.CertType != ssh.HostCert {
+		t.Errorf("expected a host certificate, got cert type %d", got.CertType)
+	}
+}
+
+// testSSHCAKeysCOAPMux handles /sshcakeys by returning userKey and hostKey as the user and host CA
+// keys respectively.
+func testSSHCAKeysCOAPMux(userKey, hostKey ssh.PublicKey) *coap.ServeMux {
+	mux := coap.NewServeMux()
+	mux.HandleFunc("/sshcakeys", func(w coap.ResponseWriter, r *coap.Request) {
+		keys := sshCAKeys{
+			UserCAKeys: []string{base64.StdEncoding.EncodeToString(userKey.Marshal())},
+			HostCAKeys: []string{base64.StdEncoding.EncodeToString(hostKey.Marshal())},
+		}
+		b, err := json.Marshal(keys)
+		if err != nil {
+			w.SetCode(codes.InternalServerError)
+			return
+		}
+		w.SetCode(codes.Content)
+		w.Write(b)
+	})
+	return mux
+}
+
+func TestThing_SSHHostKeys(t *testing.T) {
+	cert, _ := publicKeyCertificate(testGenerateSigner())
+	userSigner, err := ssh.NewSignerFromKey(testGenerateSigner())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(testGenerateSigner())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &testCOAPServer{config: dtlsServerConfig(cert), mux: testSSHCAKeysCOAPMux(userSigner.PublicKey(), hostSigner.PublicKey())}
+	addr, cancel, err := server.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	gateway := &GatewayClient{Address: addr, Key: testGenerateSigner()}
+	if err := gateway.initialise(); err != nil {
+		t.Fatal(err)
+	}
+	thing := NewThing(gateway)
+
+	userKeys, hostKeys, err := thing.SSHHostKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(userKeys) != 1 || !bytes.Equal(userKeys[0].Marshal(), userSigner.PublicKey().Marshal()) {
+		t.Error("expected the user CA key to round-trip")
+	}
+	if len(hostKeys) != 1 || !bytes.Equal(hostKeys[0].Marshal(), hostSigner.PublicKey().Marshal()) {
+		t.Error("expected the host CA key to round-trip")
+	}
+}
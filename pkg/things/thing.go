@@ -0,0 +1,28 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package things
+
+// Thing is the public identity of a single device, backed by a GatewayClient.
+type Thing struct {
+	gateway *GatewayClient
+}
+
+// NewThing returns a Thing backed by gateway, which must already be configured with the
+// credentials (a signing key, an Enroller or a PSK) needed to reach its Gateway.
+func NewThing(gateway *GatewayClient) *Thing {
+	return &Thing{gateway: gateway}
+}